@@ -1,14 +1,19 @@
 package client
 
 import (
+	"bufio"
+	stdtls "crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"os"
 	"reflect"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -18,6 +23,9 @@ import (
 	"github.com/getlantern/flashlight/proxy"
 	"github.com/getlantern/keyman"
 	"github.com/getlantern/tls"
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/h2quic"
+	"golang.org/x/net/http2"
 )
 
 const (
@@ -26,6 +34,29 @@ const (
 	REVERSE_PROXY_FLUSH_INTERVAL = 250 * time.Millisecond
 
 	X_FLASHLIGHT_QOS = "X-Flashlight-QOS"
+
+	// FAST_PROXY_BUFFER_SIZE is the size of the buffers in Client's pool of
+	// buffers used for copying fast proxy tunnels.
+	FAST_PROXY_BUFFER_SIZE = 32 * 1024
+)
+
+// Protocol identifies the wire protocol used to talk to an upstream
+// flashlight server.
+type Protocol int
+
+const (
+	// ProtocolHTTP1 dials a fresh TLS connection for every CONNECT tunnel
+	// and plain request (the historical, default behavior).
+	ProtocolHTTP1 Protocol = iota
+
+	// ProtocolHTTP2 multiplexes CONNECT tunnels and plain requests over a
+	// single HTTP/2 connection to the server, amortizing handshake cost
+	// across many concurrent requests.
+	ProtocolHTTP2
+
+	// ProtocolHTTP3 is like ProtocolHTTP2 but multiplexes over QUIC
+	// instead of TCP, which avoids head-of-line blocking on lossy links.
+	ProtocolHTTP3
 )
 
 func init() {
@@ -36,6 +67,32 @@ func init() {
 type ClientConfig struct {
 	Servers           []*ServerInfo
 	ShouldDumpHeaders bool // whether or not to dump headers of requests and responses
+
+	// RootCAProvider: (optional) if given, supplies the trusted root CA
+	// pool used to verify upstream servers' certificates in place of each
+	// ServerInfo's static RootCA field, and is consulted fresh on every
+	// handshake so the trust anchor can be rotated without restarting the
+	// client. See NewFileRootCAProvider.
+	RootCAProvider RootCAProvider
+
+	// AdaptiveWeights: if true, each server's effective weight is
+	// periodically recomputed from its measured throughput and error rate
+	// (see Client.recomputeWeights) rather than trusting the static
+	// ServerInfo.Weight for the life of the client.
+	AdaptiveWeights bool
+
+	// ServerStatsSink: (optional) if given, receives a snapshot of
+	// Client.ServerStats() every statsSinkInterval, so this data (including
+	// adaptively-tuned weights) can be published to an external stats
+	// system rather than only being queryable directly. See
+	// statreporter.NewPrometheusServerStatsSink.
+	ServerStatsSink ServerStatsSink
+}
+
+// ServerStatsSink receives periodic snapshots of ServerStats for publishing
+// to an external stats system.
+type ServerStatsSink interface {
+	ReportServerStats(stats []ServerStats)
 }
 
 // Client is an HTTP proxy that accepts connections from local programs and
@@ -50,10 +107,42 @@ type Client struct {
 	// WriteTimeout: (optional) timeout for write ops
 	WriteTimeout time.Duration
 
-	cfg                *ClientConfig
-	cfgMutex           sync.RWMutex
-	servers            []*server
-	totalServerWeights int
+	cfg                   *ClientConfig
+	cfgMutex              sync.RWMutex
+	servers               []*server
+	weightIndex           *weightIndex
+	configuredWeightTotal int
+	rootCAProvider        RootCAProvider
+	bufferPool            sync.Pool
+	bufferPoolOnce        sync.Once
+	adaptiveWeightsOnce   sync.Once
+	statsSinkOnce         sync.Once
+}
+
+// ReloadRootCAs forces an immediate reload of the client's RootCAProvider,
+// if one is configured, picking up a rotated root CA without waiting for
+// the provider's normal polling interval and without dropping any
+// connections that are already established.
+func (client *Client) ReloadRootCAs() error {
+	client.cfgMutex.RLock()
+	provider := client.rootCAProvider
+	client.cfgMutex.RUnlock()
+
+	if provider == nil {
+		return nil
+	}
+	return provider.Reload()
+}
+
+// buffers returns the Client's pool of reusable buffers for fast proxy
+// tunnels, lazily initializing it on first use.
+func (client *Client) buffers() *sync.Pool {
+	client.bufferPoolOnce.Do(func() {
+		client.bufferPool.New = func() interface{} {
+			return make([]byte, FAST_PROXY_BUFFER_SIZE)
+		}
+	})
+	return &client.bufferPool
 }
 
 // ListenAndServe makes the client listen for HTTP connections
@@ -84,6 +173,7 @@ func (client *Client) Configure(cfg *ClientConfig, enproxyConfigs []*enproxy.Con
 	}
 
 	client.cfg = cfg
+	client.rootCAProvider = cfg.RootCAProvider
 
 	// Configure servers
 	client.servers = make([]*server, len(cfg.Servers))
@@ -92,14 +182,148 @@ func (client *Client) Configure(cfg *ClientConfig, enproxyConfigs []*enproxy.Con
 		if enproxyConfigs != nil {
 			enproxyConfig = enproxyConfigs[i]
 		}
-		client.servers[i] = serverInfo.buildServer(cfg.ShouldDumpHeaders, enproxyConfig)
+		client.servers[i] = serverInfo.buildServer(cfg.ShouldDumpHeaders, enproxyConfig, cfg.RootCAProvider)
+	}
+
+	client.configuredWeightTotal = 0
+	for _, s := range client.servers {
+		client.configuredWeightTotal += s.weight
+	}
+
+	// Build the weighted-random selection index once up front, rather than
+	// recomputing total weights on every request.
+	client.weightIndex = newWeightIndex(client.servers)
+
+	if cfg.AdaptiveWeights {
+		client.adaptiveWeightsOnce.Do(func() {
+			go client.runAdaptiveWeights()
+		})
+	}
+
+	if cfg.ServerStatsSink != nil {
+		client.statsSinkOnce.Do(func() {
+			go client.runStatsSink()
+		})
+	}
+}
+
+// runAdaptiveWeights periodically recomputes each server's effective weight
+// for as long as the client lives. Only started once, the first time
+// Configure is called with AdaptiveWeights set.
+func (client *Client) runAdaptiveWeights() {
+	ticker := time.NewTicker(adaptiveWeightInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		client.recomputeWeights()
+	}
+}
+
+// adaptiveWeightInterval is how often recomputeWeights runs.
+const adaptiveWeightInterval = 30 * time.Second
+
+// statsSinkInterval is how often runStatsSink publishes to ServerStatsSink.
+const statsSinkInterval = 30 * time.Second
+
+// runStatsSink periodically publishes ServerStats to the configured
+// ServerStatsSink, for as long as the client lives. Only started once, the
+// first time Configure is called with a ServerStatsSink set.
+func (client *Client) runStatsSink() {
+	ticker := time.NewTicker(statsSinkInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		client.cfgMutex.RLock()
+		sink := client.cfg.ServerStatsSink
+		client.cfgMutex.RUnlock()
+		if sink == nil {
+			continue
+		}
+		sink.ReportServerStats(client.ServerStats())
 	}
+}
 
-	// Calculate total server weights
-	client.totalServerWeights = 0
-	for _, server := range client.servers {
-		client.totalServerWeights = client.totalServerWeights + server.weight
+// recomputeWeights rescales each healthy server's weight to
+// throughput_bps * (1 - error_rate), normalized across healthy servers so
+// their weights continue to sum to roughly configuredWeightTotal (the sum
+// of the originally configured weights), then rebuilds weightIndex to
+// reflect the new weights. Servers with no samples yet, or with every
+// healthy server scoring zero, are left at their current weight.
+func (client *Client) recomputeWeights() {
+	client.cfgMutex.Lock()
+	defer client.cfgMutex.Unlock()
+
+	if client.cfg == nil || !client.cfg.AdaptiveWeights {
+		// Adaptive weights were turned off since this loop started; leave
+		// whatever weights are currently configured alone.
+		return
+	}
+
+	type candidate struct {
+		server *server
+		score  float64
+	}
+	candidates := make([]candidate, 0, len(client.servers))
+	var total float64
+	for _, s := range client.servers {
+		if !s.health.healthy() {
+			continue
+		}
+		s.throughput.mu.Lock()
+		sampled := s.throughput.count > 0
+		s.throughput.mu.Unlock()
+		if !sampled {
+			continue
+		}
+		bps, errorRate := s.throughput.throughputAndErrorRate()
+		score := bps * (1 - errorRate)
+		candidates = append(candidates, candidate{server: s, score: score})
+		total += score
+	}
+	if total <= 0 {
+		return
+	}
+
+	const minWeight = 1
+	for _, c := range candidates {
+		weight := int(c.score / total * float64(client.configuredWeightTotal))
+		if weight < minWeight {
+			weight = minWeight
+		}
+		c.server.weight = weight
+	}
+
+	client.weightIndex = newWeightIndex(client.servers)
+}
+
+// ServerStats is a point-in-time snapshot of one configured server's health,
+// as tracked by its passive EWMA of dial errors and RTT.
+type ServerStats struct {
+	Host      string
+	Weight    int
+	QOS       int
+	Healthy   bool
+	ErrorRate float64
+	RTT       time.Duration
+}
+
+// ServerStats returns a snapshot of the health of every configured server,
+// for publishing via the stats reporter.
+func (client *Client) ServerStats() []ServerStats {
+	client.cfgMutex.RLock()
+	defer client.cfgMutex.RUnlock()
+
+	stats := make([]ServerStats, len(client.servers))
+	for i, s := range client.servers {
+		errorRate, rtt, healthy := s.health.snapshot()
+		stats[i] = ServerStats{
+			Host:      s.host,
+			Weight:    s.weight,
+			QOS:       s.qos,
+			Healthy:   healthy,
+			ErrorRate: errorRate,
+			RTT:       rtt,
+		}
 	}
+	return stats
 }
 
 // ServeHTTP implements the method from interface http.Handler
@@ -107,39 +331,154 @@ func (client *Client) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	log.Debugf("Handling request for: %s", req.RequestURI)
 	server := client.randomServer(req)
 	if req.Method == CONNECT {
-		server.enproxyConfig.Intercept(resp, req)
+		if server.fastProxy {
+			client.serveFastProxy(resp, req, server)
+		} else {
+			server.enproxyConfig.Intercept(resp, req)
+		}
 	} else {
 		server.reverseProxy.ServeHTTP(resp, req)
 	}
 }
 
-// randomServer picks a random server from the list of servers, with higher
-// weight servers more likely to be picked.  If the request includes our
-// custom QOS header, only servers whose QOS meets or exceeds the requested
-// value are considered for inclusion.  However, if no servers meet the QOS
-// requirement, the last server in the list will be used by default.
+// serveFastProxy handles a CONNECT request for a server with FastProxy
+// enabled by hijacking the client connection and tunneling it directly to
+// the upstream server, bypassing the enproxy/domain-fronting machinery
+// entirely. This is only appropriate for servers reachable without
+// domain-fronting.
+func (client *Client) serveFastProxy(resp http.ResponseWriter, req *http.Request, server *server) {
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		http.Error(resp, "Unable to hijack connection", http.StatusInternalServerError)
+		return
+	}
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(resp, fmt.Sprintf("Unable to hijack connection: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	upstreamConn, err := server.dialDirect()
+	if err != nil {
+		log.Errorf("Unable to dial upstream server for fast proxy: %s", err)
+		fmt.Fprint(clientConn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		clientConn.Close()
+		return
+	}
+
+	if err := connectUpstream(upstreamConn, req.RequestURI); err != nil {
+		log.Errorf("Unable to CONNECT to upstream server for fast proxy: %s", err)
+		fmt.Fprint(clientConn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		clientConn.Close()
+		upstreamConn.Close()
+		return
+	}
+
+	fmt.Fprint(clientConn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	client.spliceTunnel(clientConn, upstreamConn)
+}
+
+// connectUpstream issues a native HTTP CONNECT to addr over the already
+// dialed conn and waits for the 200 response that signals the tunnel is
+// established.
+func connectUpstream(conn net.Conn, addr string) error {
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: CONNECT})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected response status from upstream: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// spliceTunnel copies bytes bidirectionally between a and b until either
+// side closes. On Linux, io.CopyBuffer lets *net.TCPConn's ReaderFrom engage
+// splice(2) to copy without ever bringing the data into userspace; the
+// buffer from client.buffers() is only used as a fallback when that's not
+// possible.
+func (client *Client) spliceTunnel(a net.Conn, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go client.copyPooled(a, b, &wg)
+	go client.copyPooled(b, a, &wg)
+	wg.Wait()
+}
+
+// halfCloser is implemented by connections (e.g. *net.TCPConn, *tls.Conn)
+// that support closing only their write half, letting copyPooled propagate
+// EOF to the peer promptly instead of leaving it blocked on Read until the
+// other copyPooled goroutine finishes and spliceTunnel's deferred Close
+// runs.
+type halfCloser interface {
+	CloseWrite() error
+}
+
+func (client *Client) copyPooled(dst net.Conn, src net.Conn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	buf := client.buffers().Get().([]byte)
+	defer client.buffers().Put(buf)
+	io.CopyBuffer(dst, src, buf)
+	if hc, ok := dst.(halfCloser); ok {
+		hc.CloseWrite()
+	}
+}
+
+// maxHealthResampleAttempts bounds how many times randomServer will
+// resample the weight index looking for a healthy, QOS-eligible server
+// before falling back to a linear scan.
+const maxHealthResampleAttempts = 5
+
+// randomServer picks a weighted-random server in O(log n), skipping servers
+// that the passive health-check subsystem currently considers unhealthy
+// (see serverHealth). If the request includes our custom QOS header, only
+// servers whose QOS meets or exceeds the requested value are considered,
+// except the last server in the list, which is eligible irrespective of QOS.
+// If repeated resampling can't find an eligible, healthy server, falls back
+// to bestAvailableServer.
 func (client *Client) randomServer(req *http.Request) *server {
 	client.cfgMutex.RLock()
 	defer client.cfgMutex.RUnlock()
 
 	targetQOS := client.targetQOS(req)
+	lastServer := client.servers[len(client.servers)-1]
 
-	// Pick a random server using a target value between 0 and the total server weights
-	t := rand.Intn(client.totalServerWeights)
-	aw := 0
+	for attempt := 0; attempt < maxHealthResampleAttempts; attempt++ {
+		candidate := client.weightIndex.choose()
+		if candidate.qos < targetQOS && candidate != lastServer {
+			// QOS too low, resample
+			continue
+		}
+		if candidate.health.healthy() {
+			return candidate
+		}
+	}
+
+	return client.bestAvailableServer(targetQOS)
+}
+
+// bestAvailableServer falls back to a linear scan for a server meeting
+// targetQOS that the health-check subsystem considers healthy.  However, if
+// no server is both eligible and healthy, the last server in the list will
+// be used by default rather than dropping the request.
+func (client *Client) bestAvailableServer(targetQOS int) *server {
 	for i, server := range client.servers {
 		if i == len(client.servers)-1 {
-			// Last server, use it irrespective of target QOS
+			// Last server, use it irrespective of target QOS or health
 			return server
 		}
-		aw = aw + server.weight
 		if server.qos < targetQOS {
 			// QOS too low, exclude server from rotation
-			t = t + server.weight
 			continue
 		}
-		if aw > t {
-			// We've reached our random target value, use this server
+		if server.health.healthy() {
 			return server
 		}
 	}
@@ -162,6 +501,36 @@ func (client *Client) targetQOS(req *http.Request) int {
 	return 0
 }
 
+// weightIndex is a prefix-sum index over a set of servers' weights that
+// supports picking a weighted-random server in O(log n) via binary search,
+// rather than the O(n) linear scan this replaced.
+type weightIndex struct {
+	servers []*server
+	prefix  []int
+	total   int
+}
+
+// newWeightIndex builds a weightIndex over servers in their given order.
+// The resulting index is static; it does not change as server health
+// changes, so randomServer resamples it to route around unhealthy servers.
+func newWeightIndex(servers []*server) *weightIndex {
+	idx := &weightIndex{servers: servers, prefix: make([]int, len(servers))}
+	sum := 0
+	for i, server := range servers {
+		sum += server.weight
+		idx.prefix[i] = sum
+	}
+	idx.total = sum
+	return idx
+}
+
+// choose picks a weighted-random server from the index.
+func (idx *weightIndex) choose() *server {
+	t := rand.Intn(idx.total)
+	i := sort.Search(len(idx.prefix), func(i int) bool { return idx.prefix[i] > t })
+	return idx.servers[i]
+}
+
 // ServerInfo captures configuration information for an upstream server
 type ServerInfo struct {
 	// Host: the host (e.g. getiantem.org)
@@ -193,51 +562,113 @@ type ServerInfo struct {
 	// QOS: relative quality of service offered.  Should be >= 0, with higher
 	// values indicating higher QOS.
 	QOS int
+
+	// Protocol: the transport protocol to use for talking to this server.
+	// Defaults to ProtocolHTTP1. ProtocolHTTP2 and ProtocolHTTP3 require
+	// the stdlib crypto/tls stack rather than the getlantern/tls fork used
+	// elsewhere, so MasqueradeAs is honored via the outgoing ServerName and
+	// RootCA via the standard cert pool rather than the usual
+	// VerifyServerCerts hook.
+	Protocol Protocol
+
+	// FastProxy: if true, CONNECT requests to this server bypass the
+	// enproxy/ReverseProxy machinery and are instead tunneled directly with
+	// a native HTTP CONNECT over TLS plus a bidirectional copy (see
+	// spliceTunnel; splice(2) does not apply to the TLS leg). Only
+	// appropriate for servers reachable directly, without domain-fronting.
+	FastProxy bool
+
+	// MaxIdleConns: if set, bounds the number of pre-established enproxy
+	// connections kept idle and ready for reuse by plain (non-CONNECT)
+	// requests to this server, so a burst of requests doesn't each pay
+	// fresh dial cost. Only applies when Protocol is ProtocolHTTP1;
+	// ProtocolHTTP2 and ProtocolHTTP3 already multiplex over a single
+	// connection.
+	MaxIdleConns int
 }
 
 // buildServer builds a server configured from this serverInfo using the given
 // enproxy.Config if provided.
-func (serverInfo *ServerInfo) buildServer(shouldDumpHeaders bool, enproxyConfig *enproxy.Config) *server {
+func (serverInfo *ServerInfo) buildServer(shouldDumpHeaders bool, enproxyConfig *enproxy.Config, rootCAProvider RootCAProvider) *server {
 	weight := serverInfo.Weight
 	if weight == 0 {
 		weight = 100
 	}
 
-	if enproxyConfig == nil {
-		enproxyConfig = serverInfo.buildEnproxyConfig()
+	server := &server{
+		host:       serverInfo.Host,
+		weight:     weight,
+		qos:        serverInfo.QOS,
+		protocol:   serverInfo.Protocol,
+		fastProxy:  serverInfo.FastProxy,
+		health:     &serverHealth{},
+		throughput: &throughputTracker{},
 	}
 
-	server := &server{
-		weight:        weight,
-		qos:           serverInfo.QOS,
-		enproxyConfig: enproxyConfig,
+	switch serverInfo.Protocol {
+	case ProtocolHTTP2:
+		server.http2Transport = serverInfo.buildHTTP2Transport(rootCAProvider)
+	case ProtocolHTTP3:
+		server.h3Transport = serverInfo.buildHTTP3Transport(rootCAProvider)
+	default:
+		if serverInfo.MaxIdleConns > 0 {
+			server.pooling = newPoolingTransport(server, serverInfo.MaxIdleConns)
+		}
+	}
+
+	if serverInfo.FastProxy {
+		server.dialDirect = serverInfo.buildDialDirect(rootCAProvider)
+	}
+
+	if enproxyConfig == nil {
+		enproxyConfig = serverInfo.buildEnproxyConfig(server, rootCAProvider)
 	}
+	server.enproxyConfig = enproxyConfig
 
 	server.reverseProxy = server.buildReverseProxy(shouldDumpHeaders)
 
 	return server
 }
 
-func (serverInfo *ServerInfo) buildEnproxyConfig() *enproxy.Config {
+func (serverInfo *ServerInfo) dialTimeout() time.Duration {
 	dialTimeout := time.Duration(serverInfo.DialTimeoutMillis) * time.Millisecond
 	if dialTimeout == 0 {
 		dialTimeout = 5 * time.Second
 	}
+	return dialTimeout
+}
 
+func (serverInfo *ServerInfo) keepAlive() time.Duration {
 	keepAlive := time.Duration(serverInfo.KeepAliveMillis) * time.Millisecond
 	if keepAlive == 0 {
 		keepAlive = 70 * time.Second
 	}
+	return keepAlive
+}
+
+// buildEnproxyConfig builds the enproxy.Config used to tunnel CONNECT
+// requests to the server. For ProtocolHTTP2 and ProtocolHTTP3, tunnels ride
+// as individual streams on the server's shared HTTP/2 or HTTP/3 connection
+// (see dialWithHTTP2 and dialWithHTTP3) rather than each opening their own
+// TCP connection.
+func (serverInfo *ServerInfo) buildEnproxyConfig(server *server, rootCAProvider RootCAProvider) *enproxy.Config {
+	dialProxy := func(addr string) (net.Conn, error) {
+		return tls.DialWithDialer(
+			&net.Dialer{
+				Timeout:   serverInfo.dialTimeout(),
+				KeepAlive: serverInfo.keepAlive(),
+			},
+			"tcp", serverInfo.addressForServer(), serverInfo.tlsConfig(rootCAProvider))
+	}
+	switch server.protocol {
+	case ProtocolHTTP2:
+		dialProxy = server.dialWithHTTP2
+	case ProtocolHTTP3:
+		dialProxy = server.dialWithHTTP3
+	}
 
 	return &enproxy.Config{
-		DialProxy: func(addr string) (net.Conn, error) {
-			return tls.DialWithDialer(
-				&net.Dialer{
-					Timeout:   dialTimeout,
-					KeepAlive: keepAlive,
-				},
-				"tcp", serverInfo.addressForServer(), serverInfo.tlsConfig())
-		},
+		DialProxy: dialProxy,
 		NewRequest: func(upstreamHost string, method string, body io.Reader) (req *http.Request, err error) {
 			if upstreamHost == "" {
 				// No specific host requested, use configured one
@@ -248,6 +679,107 @@ func (serverInfo *ServerInfo) buildEnproxyConfig() *enproxy.Config {
 	}
 }
 
+// stdTLSConfig builds a standard library *tls.Config for use with
+// transports, like http2.Transport and h2quic.RoundTripper, that hard-code
+// crypto/tls and so can't take the getlantern/tls fork used by tlsConfig. If
+// rootCAProvider is non-nil, it takes precedence over the static RootCA
+// field and is consulted fresh on every handshake via VerifyPeerCertificate
+// (stdlib's own cfg.RootCAs-based check is disabled in favor of this, the
+// same way tlsConfig substitutes VerifyServerCerts for its built-in check),
+// so the trust anchor can be rotated without restarting the client.
+func (serverInfo *ServerInfo) stdTLSConfig(rootCAProvider RootCAProvider) *stdtls.Config {
+	cfg := &stdtls.Config{
+		ServerName:         serverInfo.serverHost(),
+		InsecureSkipVerify: serverInfo.InsecureSkipVerify,
+	}
+	if serverInfo.InsecureSkipVerify {
+		return cfg
+	}
+
+	staticRoots := serverInfo.staticRootCAs()
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		roots := staticRoots
+		if rootCAProvider != nil {
+			roots = rootCAProvider.CurrentPool()
+		}
+
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+
+		opts := x509.VerifyOptions{
+			DNSName:       serverInfo.serverHost(),
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+	return cfg
+}
+
+// buildHTTP2Transport builds an http2.Transport that dials the server over a
+// single TLS connection and multiplexes every request onto it, instead of
+// opening a new connection per request like http.Transport does with
+// DisableKeepAlives. The dial target always ignores the requested addr in
+// favor of the server's own address, mirroring dialWithEnproxy.
+func (serverInfo *ServerInfo) buildHTTP2Transport(rootCAProvider RootCAProvider) *http2.Transport {
+	return &http2.Transport{
+		DialTLS: func(network, addr string, _ *stdtls.Config) (net.Conn, error) {
+			return stdtls.DialWithDialer(
+				&net.Dialer{
+					Timeout:   serverInfo.dialTimeout(),
+					KeepAlive: serverInfo.keepAlive(),
+				},
+				network, serverInfo.addressForServer(), serverInfo.stdTLSConfig(rootCAProvider))
+		},
+	}
+}
+
+// buildHTTP3Transport builds an h2quic.RoundTripper that speaks HTTP/3 over
+// QUIC to the server. Like buildHTTP2Transport's DialTLS, Dial always
+// ignores the requested addr in favor of the server's own address, mirroring
+// dialWithEnproxy; without this override, h2quic.RoundTripper would dial
+// whatever host a RoundTrip's request URL names, completely bypassing the
+// configured flashlight server.
+func (serverInfo *ServerInfo) buildHTTP3Transport(rootCAProvider RootCAProvider) *h2quic.RoundTripper {
+	tlsConfig := serverInfo.stdTLSConfig(rootCAProvider)
+	return &h2quic.RoundTripper{
+		TLSClientConfig: tlsConfig,
+		Dial: func(network, addr string, _ *stdtls.Config, quicConfig *quic.Config) (quic.Session, error) {
+			return quic.DialAddr(serverInfo.addressForServer(), tlsConfig, quicConfig)
+		},
+	}
+}
+
+// buildDialDirect builds the dial function used by FastProxy servers to
+// open a TLS connection straight to the server (still bypassing the
+// enproxy/ReverseProxy machinery). FastProxy only skips domain-fronting's
+// SNI-spoofing step, not encryption: connectUpstream's CONNECT line carries
+// the real destination host, so this leg must be as encrypted as every
+// other transport in this file. Once TLS is in place, the resulting
+// net.Conn is a *tls.Conn rather than a bare *net.TCPConn, so spliceTunnel's
+// splice(2) fast path no longer applies to this leg; that tradeoff is
+// required for FastProxy to be safe to use at all.
+func (serverInfo *ServerInfo) buildDialDirect(rootCAProvider RootCAProvider) func() (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   serverInfo.dialTimeout(),
+		KeepAlive: serverInfo.keepAlive(),
+	}
+	return func() (net.Conn, error) {
+		return tls.DialWithDialer(dialer, "tcp", serverInfo.addressForServer(), serverInfo.tlsConfig(rootCAProvider))
+	}
+}
+
 // Get the address to dial for reaching the server
 func (serverInfo *ServerInfo) addressForServer() string {
 	return fmt.Sprintf("%s:%d", serverInfo.serverHost(), serverInfo.Port)
@@ -261,16 +793,26 @@ func (serverInfo *ServerInfo) serverHost() string {
 	return serverHost
 }
 
-// Build a tls.Config for dialing the upstream host
-func (serverInfo *ServerInfo) tlsConfig() *tls.Config {
+// Build a tls.Config for dialing the upstream host. If rootCAProvider is
+// non-nil, it takes precedence over the static RootCA field and is
+// consulted fresh on every handshake, so the trust anchor can be rotated
+// (e.g. via NewFileRootCAProvider) without restarting the client.
+func (serverInfo *ServerInfo) tlsConfig(rootCAProvider RootCAProvider) *tls.Config {
 	tlsConfig := &tls.Config{
 		ClientSessionCache: tls.NewLRUClientSessionCache(1000),
 		InsecureSkipVerify: serverInfo.InsecureSkipVerify,
 	}
 
+	staticRoots := serverInfo.staticRootCAs()
+
 	tlsConfig.VerifyServerCerts = func(certs []*x509.Certificate) ([][]*x509.Certificate, error) {
+		roots := staticRoots
+		if rootCAProvider != nil {
+			roots = rootCAProvider.CurrentPool()
+		}
 		return tlsConfig.DefaultVerifyServerCerts(certs, &x509.VerifyOptions{
 			DNSName: serverInfo.serverHost(),
+			Roots:   roots,
 		})
 	}
 
@@ -279,36 +821,321 @@ func (serverInfo *ServerInfo) tlsConfig() *tls.Config {
 	// includes a server name, Fastly checks to make sure that this matches the
 	// Host header in the HTTP request and if they don't match, it returns a
 	// 400 Bad Request error.
-	if serverInfo.RootCA != "" {
-		caCert, err := keyman.LoadCertificateFromPEMBytes([]byte(serverInfo.RootCA))
+	if staticRoots != nil {
+		tlsConfig.RootCAs = staticRoots
+	}
+	return tlsConfig
+}
+
+// staticRootCAs loads the PEM-encoded RootCA field into a cert pool once,
+// up front, so the common case (no RootCAProvider) doesn't pay to re-parse
+// it on every handshake.
+func (serverInfo *ServerInfo) staticRootCAs() *x509.CertPool {
+	if serverInfo.RootCA == "" {
+		return nil
+	}
+	caCert, err := keyman.LoadCertificateFromPEMBytes([]byte(serverInfo.RootCA))
+	if err != nil {
+		log.Fatalf("Unable to load root ca cert: %s", err)
+	}
+	return caCert.PoolContainingCert()
+}
+
+// RootCAProvider supplies a pool of trusted root CAs for verifying upstream
+// servers' certificates, and supports live rotation of that pool without
+// restarting the client. See NewFileRootCAProvider.
+type RootCAProvider interface {
+	// CurrentPool returns the current trusted root CA pool. This is called
+	// on every TLS handshake, so implementations should keep it cheap (e.g.
+	// return an already-parsed pool rather than re-parsing PEM data).
+	CurrentPool() *x509.CertPool
+
+	// Changed returns a channel that receives a value when CurrentPool
+	// starts returning a new pool. Changes made while a notification is
+	// still unread may be coalesced into that single notification.
+	Changed() <-chan struct{}
+
+	// Reload forces an immediate refresh of the pool, rather than waiting
+	// for whatever polling interval (if any) the provider normally uses.
+	Reload() error
+}
+
+// fileRootCAPollInterval is how often a FileRootCAProvider checks its
+// watched file's mtime for changes.
+const fileRootCAPollInterval = 10 * time.Second
+
+// FileRootCAProvider is a RootCAProvider backed by a PEM file on disk. It
+// reloads the file whenever its mtime advances, either noticed by its
+// background poller or forced via Reload, so operators can rotate the
+// trust anchor by writing a new PEM to the same path.
+type FileRootCAProvider struct {
+	path    string
+	mu      sync.Mutex
+	pool    *x509.CertPool
+	modTime time.Time
+	changed chan struct{}
+}
+
+// NewFileRootCAProvider builds a FileRootCAProvider that watches path,
+// performing an initial synchronous load so the returned provider is ready
+// to use immediately.
+func NewFileRootCAProvider(path string) (*FileRootCAProvider, error) {
+	provider := &FileRootCAProvider{
+		path:    path,
+		changed: make(chan struct{}, 1),
+	}
+	if err := provider.reload(); err != nil {
+		return nil, err
+	}
+	go provider.watch()
+	return provider, nil
+}
+
+// CurrentPool implements the RootCAProvider interface.
+func (provider *FileRootCAProvider) CurrentPool() *x509.CertPool {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	return provider.pool
+}
+
+// Changed implements the RootCAProvider interface.
+func (provider *FileRootCAProvider) Changed() <-chan struct{} {
+	return provider.changed
+}
+
+// Reload implements the RootCAProvider interface.
+func (provider *FileRootCAProvider) Reload() error {
+	return provider.reload()
+}
+
+func (provider *FileRootCAProvider) reload() error {
+	pemBytes, err := ioutil.ReadFile(provider.path)
+	if err != nil {
+		return fmt.Errorf("Unable to read root CA file %s: %s", provider.path, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		return fmt.Errorf("No certificates found in root CA file %s", provider.path)
+	}
+	info, err := os.Stat(provider.path)
+	if err != nil {
+		return fmt.Errorf("Unable to stat root CA file %s: %s", provider.path, err)
+	}
+
+	provider.mu.Lock()
+	provider.pool = pool
+	provider.modTime = info.ModTime()
+	provider.mu.Unlock()
+
+	select {
+	case provider.changed <- struct{}{}:
+	default:
+		// Unread notification already pending, no need to double up
+	}
+	return nil
+}
+
+// watch polls the root CA file's mtime and reloads it whenever that
+// advances, so CurrentPool picks up a rotated CA without a restart.
+func (provider *FileRootCAProvider) watch() {
+	ticker := time.NewTicker(fileRootCAPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		info, err := os.Stat(provider.path)
 		if err != nil {
-			log.Fatalf("Unable to load root ca cert: %s", err)
+			log.Errorf("Unable to stat root CA file %s: %s", provider.path, err)
+			continue
+		}
+
+		provider.mu.Lock()
+		changed := info.ModTime().After(provider.modTime)
+		provider.mu.Unlock()
+		if !changed {
+			continue
+		}
+
+		if err := provider.reload(); err != nil {
+			log.Errorf("Unable to reload root CA file %s: %s", provider.path, err)
 		}
-		tlsConfig.RootCAs = caCert.PoolContainingCert()
 	}
-	return tlsConfig
 }
 
 // type server represents an upstream server that proxies traffic for clients
 type server struct {
-	weight        int
-	qos           int
-	enproxyConfig *enproxy.Config
-	reverseProxy  *httputil.ReverseProxy
+	host           string
+	weight         int
+	qos            int
+	protocol       Protocol
+	enproxyConfig  *enproxy.Config
+	reverseProxy   *httputil.ReverseProxy
+	http2Transport *http2.Transport
+	h3Transport    *h2quic.RoundTripper
+	fastProxy      bool
+	dialDirect     func() (net.Conn, error)
+	health         *serverHealth
+	pooling        *PoolingTransport
+	throughput     *throughputTracker
 }
 
+// dialWithEnproxy dials a new connection to the server for use in an
+// enproxy tunnel, recording the outcome (and RTT, on success) with the
+// server's health subsystem.
 func (server *server) dialWithEnproxy(network, addr string) (net.Conn, error) {
+	start := time.Now()
 	conn := &enproxy.Conn{
 		Addr:   addr,
 		Config: server.enproxyConfig,
 	}
 	err := conn.Connect()
 	if err != nil {
+		server.health.recordFailure()
 		return nil, err
 	}
+	server.health.recordSuccess(time.Since(start))
 	return conn, nil
 }
 
+const (
+	// healthEWMAAlpha weights how much each new sample contributes to a
+	// server's rolling EWMA of dial errors and RTT; higher values adapt
+	// faster but are noisier.
+	healthEWMAAlpha = 0.2
+
+	healthBackoffBase    = 1 * time.Second
+	healthBackoffMax     = 2 * time.Minute
+	healthBackoffMaxSkew = 10 // caps the exponent so the shift can't overflow
+)
+
+// serverHealth tracks a rolling EWMA of dial errors and RTT for a server, as
+// updated by dialWithEnproxy, and derives from it a temporary exponential
+// backoff during which the server is excluded from the weight pool by
+// randomServer.
+type serverHealth struct {
+	mu           sync.Mutex
+	errorEWMA    float64
+	rttEWMA      time.Duration
+	failureCount int
+	backoffUntil time.Time
+}
+
+// recordFailure registers a dial failure, pushing the error EWMA up and
+// extending the server's exponential backoff.
+func (h *serverHealth) recordFailure() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.errorEWMA = healthEWMAAlpha + (1-healthEWMAAlpha)*h.errorEWMA
+	h.failureCount++
+
+	shift := h.failureCount - 1
+	if shift > healthBackoffMaxSkew {
+		shift = healthBackoffMaxSkew
+	}
+	backoff := healthBackoffBase << uint(shift)
+	if backoff > healthBackoffMax {
+		backoff = healthBackoffMax
+	}
+	h.backoffUntil = time.Now().Add(backoff)
+}
+
+// recordSuccess registers a successful dial with the observed RTT, decaying
+// the error EWMA and clearing any backoff.
+func (h *serverHealth) recordSuccess(rtt time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.errorEWMA = (1 - healthEWMAAlpha) * h.errorEWMA
+	if h.rttEWMA == 0 {
+		h.rttEWMA = rtt
+	} else {
+		h.rttEWMA = time.Duration(healthEWMAAlpha*float64(rtt) + (1-healthEWMAAlpha)*float64(h.rttEWMA))
+	}
+	h.failureCount = 0
+	h.backoffUntil = time.Time{}
+}
+
+// healthy reports whether the server is currently outside its backoff
+// window.
+func (h *serverHealth) healthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Now().After(h.backoffUntil)
+}
+
+// snapshot returns the current error rate, RTT and health of the server, for
+// ServerStats.
+func (h *serverHealth) snapshot() (errorRate float64, rtt time.Duration, healthy bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.errorEWMA, h.rttEWMA, time.Now().After(h.backoffUntil)
+}
+
+// dialWithHTTP2 opens a tunnel (an enproxy tunnel, for CONNECT traffic, or a
+// plain request's own connection, for everything else - see transport) as a
+// single stream on the server's shared HTTP/2 connection
+// (server.http2Transport), rather than dialing a new TCP connection the way
+// dialWithEnproxy does. The request body and response body are wired up as
+// the write and read halves, respectively, of the returned net.Conn, so
+// whatever protocol rides on top can frame itself over them exactly as it
+// would a raw socket.
+func (server *server) dialWithHTTP2(addr string) (net.Conn, error) {
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("PUT", "https://"+addr+"/", pr)
+	if err != nil {
+		pw.Close()
+		return nil, fmt.Errorf("Unable to construct HTTP/2 tunnel request: %s", err)
+	}
+	req.ContentLength = -1
+
+	start := time.Now()
+	resp, err := server.http2Transport.RoundTrip(req)
+	if err != nil {
+		pw.Close()
+		server.health.recordFailure()
+		return nil, fmt.Errorf("Unable to open HTTP/2 tunnel: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		pw.Close()
+		resp.Body.Close()
+		server.health.recordFailure()
+		return nil, fmt.Errorf("Unexpected response status opening HTTP/2 tunnel: %d", resp.StatusCode)
+	}
+	server.health.recordSuccess(time.Since(start))
+
+	return &streamTunnelConn{reader: resp.Body, writer: pw}, nil
+}
+
+// dialWithHTTP3 is dialWithHTTP2's counterpart for ProtocolHTTP3 servers: it
+// opens a tunnel as a single stream on the server's shared HTTP/3 (QUIC)
+// connection (server.h3Transport) instead of HTTP/2's.
+func (server *server) dialWithHTTP3(addr string) (net.Conn, error) {
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("PUT", "https://"+addr+"/", pr)
+	if err != nil {
+		pw.Close()
+		return nil, fmt.Errorf("Unable to construct HTTP/3 tunnel request: %s", err)
+	}
+	req.ContentLength = -1
+
+	start := time.Now()
+	resp, err := server.h3Transport.RoundTrip(req)
+	if err != nil {
+		pw.Close()
+		server.health.recordFailure()
+		return nil, fmt.Errorf("Unable to open HTTP/3 tunnel: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		pw.Close()
+		resp.Body.Close()
+		server.health.recordFailure()
+		return nil, fmt.Errorf("Unexpected response status opening HTTP/3 tunnel: %d", resp.StatusCode)
+	}
+	server.health.recordSuccess(time.Since(start))
+
+	return &streamTunnelConn{reader: resp.Body, writer: pw}, nil
+}
+
 // buildReverseProxy builds the httputil.ReverseProxy used to proxy requests to
 // the server.
 func (server *server) buildReverseProxy(shouldDumpHeaders bool) *httputil.ReverseProxy {
@@ -316,25 +1143,95 @@ func (server *server) buildReverseProxy(shouldDumpHeaders bool) *httputil.Revers
 		Director: func(req *http.Request) {
 			// do nothing
 		},
-		Transport: withDumpHeaders(
-			shouldDumpHeaders,
-			&http.Transport{
-				// We disable keepalives because some servers pretend to support
-				// keep-alives but close their connections immediately, which
-				// causes an error inside ReverseProxy.  This is not an issue
-				// for HTTPS because  the browser is responsible for handling
-				// the problem, which browsers like Chrome and Firefox already
-				// know to do.
-				// See https://code.google.com/p/go/issues/detail?id=4677
-				DisableKeepAlives: true,
-				Dial:              server.dialWithEnproxy,
-			}),
+		Transport: withDumpHeaders(shouldDumpHeaders, withThroughputSampling(server.throughput, server.transport())),
 		// Set a FlushInterval to prevent overly aggressive buffering of
 		// responses, which helps keep memory usage down
 		FlushInterval: 250 * time.Millisecond,
 	}
 }
 
+// transport returns the http.RoundTripper to use for plain (non-CONNECT)
+// requests, based on the server's configured Protocol.
+func (server *server) transport() http.RoundTripper {
+	switch server.protocol {
+	case ProtocolHTTP2:
+		// A plain request can't simply be replayed on http2Transport
+		// directly: req.URL.Scheme is "http" (that's the scheme of the
+		// client's real target, which this Director leaves untouched), and
+		// http2.Transport rejects any request that isn't https. Even
+		// setting that aside, http2Transport.DialTLS always dials the
+		// server's own address regardless of the requested addr (see
+		// buildHTTP2Transport), so it has no way to route a RoundTrip on to
+		// the request's actual destination. Instead, treat the request
+		// exactly like an enproxy-tunneled CONNECT request: dial a fresh
+		// tunnel (a new HTTP/2 stream, not a new connection) via
+		// dialWithHTTP2, and let http.Transport write the request and read
+		// the response over it, the same way the default case below does
+		// with dialWithEnproxy.
+		return &http.Transport{
+			DisableKeepAlives: true,
+			Dial: func(network, addr string) (net.Conn, error) {
+				return server.dialWithHTTP2(addr)
+			},
+		}
+	case ProtocolHTTP3:
+		// See the ProtocolHTTP2 case above; dialWithHTTP3 is its HTTP/3
+		// counterpart.
+		return &http.Transport{
+			DisableKeepAlives: true,
+			Dial: func(network, addr string) (net.Conn, error) {
+				return server.dialWithHTTP3(addr)
+			},
+		}
+	default:
+		if server.pooling != nil {
+			return server.pooling
+		}
+		return &http.Transport{
+			// We disable keepalives because some servers pretend to support
+			// keep-alives but close their connections immediately, which
+			// causes an error inside ReverseProxy.  This is not an issue
+			// for HTTPS because  the browser is responsible for handling
+			// the problem, which browsers like Chrome and Firefox already
+			// know to do.
+			// See https://code.google.com/p/go/issues/detail?id=4677
+			DisableKeepAlives: true,
+			Dial:              server.dialWithEnproxy,
+		}
+	}
+}
+
+// streamTunnelConn adapts a single streamed request/response pair - either
+// HTTP/2 (dialWithHTTP2) or HTTP/3 (dialWithHTTP3) - to the net.Conn
+// interface, so a tunnel (enproxy's, or a plain request's own) can ride over
+// one multiplexed stream instead of its own TCP connection.
+type streamTunnelConn struct {
+	reader io.ReadCloser
+	writer *io.PipeWriter
+}
+
+func (c *streamTunnelConn) Read(b []byte) (int, error)  { return c.reader.Read(b) }
+func (c *streamTunnelConn) Write(b []byte) (int, error) { return c.writer.Write(b) }
+
+func (c *streamTunnelConn) Close() error {
+	c.writer.Close()
+	return c.reader.Close()
+}
+
+func (c *streamTunnelConn) LocalAddr() net.Addr                { return streamTunnelAddr{} }
+func (c *streamTunnelConn) RemoteAddr() net.Addr               { return streamTunnelAddr{} }
+func (c *streamTunnelConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamTunnelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamTunnelConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// streamTunnelAddr is a stand-in net.Addr for streamTunnelConn, which has no
+// addressing of its own since it's a logical stream over a shared
+// connection.
+type streamTunnelAddr struct{}
+
+func (streamTunnelAddr) Network() string { return "stream-tunnel" }
+func (streamTunnelAddr) String() string  { return "stream-tunnel" }
+
 // withDumpHeaders creates a RoundTripper that uses the supplied RoundTripper
 // and that dumps headers is client is so configured.
 func withDumpHeaders(shouldDumpHeaders bool, rt http.RoundTripper) http.RoundTripper {
@@ -357,4 +1254,4 @@ func (rt *headerDumpingRoundTripper) RoundTrip(req *http.Request) (resp *http.Re
 		proxy.DumpHeaders("Response", &resp.Header)
 	}
 	return
-}
\ No newline at end of file
+}
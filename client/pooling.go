@@ -0,0 +1,265 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// poolIdleTTL bounds how long a pooled connection can sit idle before
+// PoolingTransport treats it as stale and redials instead of reusing it.
+// enproxy.Conn's Read/SetReadDeadline semantics aren't something this
+// package can assume (it's not a bare socket; it implements its own framing
+// over the underlying transport), so unlike a typical connection pool this
+// can't probe liveness with a zero-wait Read without risking a spurious
+// protocol-level read against that framing. A TTL alone doesn't rule out the
+// failure mode http.Transport's DisableKeepAlives elsewhere in this package
+// guards against - some servers close "keep-alive" connections immediately,
+// well within poolIdleTTL - so RoundTrip pairs this TTL with a one-time
+// retry against a fresh connection whenever a reused one fails outright.
+const poolIdleTTL = 30 * time.Second
+
+// PoolingTransport is an http.RoundTripper that keeps a bounded pool of
+// pre-established connections to a server, so a burst of requests doesn't
+// each pay fresh dial (and, absent domain-fronting, handshake) cost. It's
+// only used for ProtocolHTTP1 servers with ServerInfo.MaxIdleConns set;
+// ProtocolHTTP2/ProtocolHTTP3 already multiplex over a single connection.
+type PoolingTransport struct {
+	server *server
+	idle   chan idleConn
+	rt     *http.Transport
+}
+
+// idleConn is a pooled connection together with the time it was returned to
+// the pool, used to evict it once it's older than poolIdleTTL.
+type idleConn struct {
+	conn     net.Conn
+	pooledAt time.Time
+}
+
+// newPoolingTransport builds a PoolingTransport that pools up to
+// maxIdleConns connections dialed via server.dialWithEnproxy.
+func newPoolingTransport(server *server, maxIdleConns int) *PoolingTransport {
+	pt := &PoolingTransport{
+		server: server,
+		idle:   make(chan idleConn, maxIdleConns),
+	}
+	pt.rt = &http.Transport{
+		DisableKeepAlives: true,
+		DialContext:       pt.dial,
+	}
+	return pt
+}
+
+// dialOutcomeKey is the context key RoundTrip uses to pass a *dialOutcome
+// into dial, so it can learn whether the connection dial returned came from
+// the idle pool or was freshly dialed.
+type dialOutcomeKey struct{}
+
+// dialOutcome records whether a dial call returned a pooled (reused)
+// connection, so RoundTrip knows whether a request that failed over it is
+// eligible for a retry against a fresh connection.
+type dialOutcome struct {
+	reused bool
+	// fresh, if set, makes dial skip the idle pool and always dial anew.
+	fresh bool
+}
+
+// dial returns a pooled idle connection if one is available and not past
+// poolIdleTTL, else falls back to dialing a fresh one.
+func (pt *PoolingTransport) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	outcome, _ := ctx.Value(dialOutcomeKey{}).(*dialOutcome)
+
+	for outcome == nil || !outcome.fresh {
+		select {
+		case ic := <-pt.idle:
+			if time.Since(ic.pooledAt) > poolIdleTTL {
+				ic.conn.Close()
+				continue
+			}
+			if outcome != nil {
+				outcome.reused = true
+			}
+			return &pooledConn{Conn: ic.conn, pool: pt}, nil
+		default:
+		}
+		break
+	}
+
+	conn, err := pt.server.dialWithEnproxy(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledConn{Conn: conn, pool: pt}, nil
+}
+
+// RoundTrip implements the http.RoundTripper interface. A pooled connection
+// can be stale despite being within poolIdleTTL - the peer may have closed
+// it right after the last request - so if a request made over a reused
+// connection fails outright (no response was read at all), RoundTrip
+// retries it once against a freshly dialed connection before giving up. The
+// retry is skipped if the request had a body that can't be safely replayed
+// (no GetBody), since the first attempt may have already consumed it.
+func (pt *PoolingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	outcome := &dialOutcome{}
+	resp, err := pt.roundTrip(req, outcome)
+	if err == nil || !outcome.reused {
+		return resp, err
+	}
+
+	if req.Body != nil {
+		if req.GetBody == nil {
+			return resp, err
+		}
+		body, bodyErr := req.GetBody()
+		if bodyErr != nil {
+			return resp, err
+		}
+		req.Body = body
+	}
+
+	return pt.roundTrip(req, &dialOutcome{fresh: true})
+}
+
+func (pt *PoolingTransport) roundTrip(req *http.Request, outcome *dialOutcome) (*http.Response, error) {
+	ctx := context.WithValue(req.Context(), dialOutcomeKey{}, outcome)
+	return pt.rt.RoundTrip(req.WithContext(ctx))
+}
+
+// pooledConn wraps a net.Conn so that, instead of actually closing it,
+// Close returns it to its PoolingTransport's idle pool (up to capacity).
+type pooledConn struct {
+	net.Conn
+	pool *PoolingTransport
+}
+
+func (pc *pooledConn) Close() error {
+	select {
+	case pc.pool.idle <- idleConn{conn: pc.Conn, pooledAt: time.Now()}:
+		return nil
+	default:
+		return pc.Conn.Close()
+	}
+}
+
+// throughputSampleWindow is the number of recent (bytes, duration, err)
+// samples a throughputTracker averages over when computing a server's
+// adaptive weight.
+const throughputSampleWindow = 32
+
+type throughputSample struct {
+	bytes    int64
+	duration time.Duration
+	err      bool
+}
+
+// throughputTracker is a fixed-size ring buffer of recent request outcomes
+// for one server, used to drive adaptive weight tuning (see
+// Client.recomputeWeights).
+type throughputTracker struct {
+	mu      sync.Mutex
+	samples [throughputSampleWindow]throughputSample
+	next    int
+	count   int
+}
+
+func (t *throughputTracker) record(bytes int64, duration time.Duration, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.samples[t.next] = throughputSample{bytes: bytes, duration: duration, err: failed}
+	t.next = (t.next + 1) % throughputSampleWindow
+	if t.count < throughputSampleWindow {
+		t.count++
+	}
+}
+
+// throughputAndErrorRate returns the average measured throughput in bytes
+// per second and the error rate over the current sample window.
+func (t *throughputTracker) throughputAndErrorRate() (bps float64, errorRate float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.count == 0 {
+		return 0, 0
+	}
+
+	var totalBytes int64
+	var totalDuration time.Duration
+	var errs int
+	for i := 0; i < t.count; i++ {
+		sample := t.samples[i]
+		totalBytes += sample.bytes
+		totalDuration += sample.duration
+		if sample.err {
+			errs++
+		}
+	}
+
+	errorRate = float64(errs) / float64(t.count)
+	if totalDuration > 0 {
+		bps = float64(totalBytes) / totalDuration.Seconds()
+	}
+	return bps, errorRate
+}
+
+// throughputSamplingRoundTripper wraps another http.RoundTripper, recording
+// each request's (bytes, duration, err) into a throughputTracker.
+type throughputSamplingRoundTripper struct {
+	orig    http.RoundTripper
+	tracker *throughputTracker
+}
+
+// withThroughputSampling wraps rt so every request it handles is recorded
+// into tracker for adaptive weight tuning.
+func withThroughputSampling(tracker *throughputTracker, rt http.RoundTripper) http.RoundTripper {
+	return &throughputSamplingRoundTripper{orig: rt, tracker: tracker}
+}
+
+// RoundTrip records a sample once the response body has been fully read and
+// closed (rather than when headers arrive), so both the measured duration
+// and byte count reflect the whole transfer, not just time-to-headers. This
+// matters for the common proxied case of chunked/unknown-length responses,
+// where ContentLength is -1.
+func (rt *throughputSamplingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := rt.orig.RoundTrip(req)
+	if err != nil {
+		rt.tracker.record(0, time.Since(start), true)
+		return resp, err
+	}
+
+	resp.Body = &sampledBody{ReadCloser: resp.Body, tracker: rt.tracker, start: start}
+	return resp, nil
+}
+
+// sampledBody wraps a response body, counting bytes as they're read and
+// recording a throughput sample once the body is closed.
+type sampledBody struct {
+	io.ReadCloser
+	tracker *throughputTracker
+	start   time.Time
+	bytes   int64
+	failed  bool
+	once    sync.Once
+}
+
+func (b *sampledBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	if err != nil && err != io.EOF {
+		b.failed = true
+	}
+	return n, err
+}
+
+func (b *sampledBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.tracker.record(b.bytes, time.Since(b.start), b.failed || err != nil)
+	})
+	return err
+}
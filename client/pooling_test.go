@@ -0,0 +1,41 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThroughputTrackerAverages(t *testing.T) {
+	tracker := &throughputTracker{}
+	tracker.record(1000, time.Second, false)
+	tracker.record(3000, time.Second, false)
+
+	bps, errorRate := tracker.throughputAndErrorRate()
+	if bps != 2000 {
+		t.Fatalf("expected 2000 bytes/sec, got %f", bps)
+	}
+	if errorRate != 0 {
+		t.Fatalf("expected 0 error rate, got %f", errorRate)
+	}
+}
+
+func TestThroughputTrackerErrorRate(t *testing.T) {
+	tracker := &throughputTracker{}
+	tracker.record(0, time.Second, true)
+	tracker.record(1000, time.Second, false)
+
+	_, errorRate := tracker.throughputAndErrorRate()
+	if errorRate != 0.5 {
+		t.Fatalf("expected 0.5 error rate, got %f", errorRate)
+	}
+}
+
+func TestThroughputTrackerWindowEviction(t *testing.T) {
+	tracker := &throughputTracker{}
+	for i := 0; i < throughputSampleWindow+5; i++ {
+		tracker.record(int64(i), time.Second, false)
+	}
+	if tracker.count != throughputSampleWindow {
+		t.Fatalf("expected count capped at %d, got %d", throughputSampleWindow, tracker.count)
+	}
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewWeightIndexPrefixSums(t *testing.T) {
+	servers := []*server{{weight: 10}, {weight: 20}, {weight: 30}}
+	idx := newWeightIndex(servers)
+
+	if idx.total != 60 {
+		t.Fatalf("expected total 60, got %d", idx.total)
+	}
+	want := []int{10, 30, 60}
+	for i, w := range want {
+		if idx.prefix[i] != w {
+			t.Errorf("prefix[%d] = %d, want %d", i, idx.prefix[i], w)
+		}
+	}
+}
+
+func TestWeightIndexChooseStaysInBounds(t *testing.T) {
+	servers := []*server{{weight: 1}, {weight: 1}, {weight: 1}}
+	idx := newWeightIndex(servers)
+
+	for i := 0; i < 100; i++ {
+		chosen := idx.choose()
+		found := false
+		for _, s := range servers {
+			if s == chosen {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("choose() returned a server not in the index: %+v", chosen)
+		}
+	}
+}
+
+func TestServerHealthBackoff(t *testing.T) {
+	h := &serverHealth{}
+	if !h.healthy() {
+		t.Fatal("expected fresh serverHealth to be healthy")
+	}
+
+	h.recordFailure()
+	if h.healthy() {
+		t.Fatal("expected serverHealth to be unhealthy immediately after a failure")
+	}
+
+	h.recordSuccess(10 * time.Millisecond)
+	if !h.healthy() {
+		t.Fatal("expected serverHealth to be healthy again after a success")
+	}
+
+	errorRate, rtt, healthy := h.snapshot()
+	if !healthy {
+		t.Fatal("expected snapshot to report healthy")
+	}
+	if rtt != 10*time.Millisecond {
+		t.Fatalf("expected rtt 10ms, got %s", rtt)
+	}
+	if errorRate < 0 || errorRate >= 1 {
+		t.Fatalf("expected errorRate in [0,1), got %f", errorRate)
+	}
+}
@@ -0,0 +1,23 @@
+package statreporter
+
+import "github.com/getlantern/flashlight/client"
+
+// PrometheusServerStatsSink adapts a PrometheusSink to client.ServerStatsSink,
+// so a Client can be configured with ClientConfig.ServerStatsSink to publish
+// its periodic ServerStats snapshots as Prometheus gauges.
+type PrometheusServerStatsSink struct {
+	sink *PrometheusSink
+}
+
+// NewPrometheusServerStatsSink wraps sink so it can be set as a
+// ClientConfig.ServerStatsSink.
+func NewPrometheusServerStatsSink(sink *PrometheusSink) *PrometheusServerStatsSink {
+	return &PrometheusServerStatsSink{sink: sink}
+}
+
+func (s *PrometheusServerStatsSink) ReportServerStats(stats []client.ServerStats) {
+	for _, stat := range stats {
+		s.sink.RecordErrorRate(stat.Host, stat.ErrorRate)
+		s.sink.RecordServerWeight(stat.Host, stat.Weight)
+	}
+}
@@ -0,0 +1,88 @@
+package statreporter
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// OTLPSink is a Sink that publishes flashlight's stats as OpenTelemetry
+// metrics via an OTLP/gRPC exporter, for ingestion by any OTLP-compatible
+// collector instead of the bespoke statshub JSON schema.
+type OTLPSink struct {
+	provider        *sdkmetric.MeterProvider
+	bytesGiven      metric.Int64Counter
+	traversalsTotal metric.Int64Counter
+	traversalsOK    metric.Int64Counter
+}
+
+// NewOTLPSink dials the given OTLP/gRPC collector endpoint (e.g.
+// "localhost:4317") and builds an OTLPSink that exports to it on
+// REPORT_STATS_INTERVAL, in addition to whatever Flush forces.
+func NewOTLPSink(ctx context.Context, collectorEndpoint string) (*OTLPSink, error) {
+	exporter, err := otlpmetricgrpc.New(ctx,
+		otlpmetricgrpc.WithEndpoint(collectorEndpoint),
+		otlpmetricgrpc.WithInsecure(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to build OTLP exporter: %s", err)
+	}
+
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(REPORT_STATS_INTERVAL))),
+	)
+	meter := provider.Meter("github.com/getlantern/flashlight/statreporter")
+
+	bytesGiven, err := meter.Int64Counter("bytes_given_total")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create bytes_given_total instrument: %s", err)
+	}
+	traversalsTotal, err := meter.Int64Counter("traversals_total")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create traversals_total instrument: %s", err)
+	}
+	traversalsOK, err := meter.Int64Counter("traversals_succeeded_total")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create traversals_succeeded_total instrument: %s", err)
+	}
+
+	return &OTLPSink{
+		provider:        provider,
+		bytesGiven:      bytesGiven,
+		traversalsTotal: traversalsTotal,
+		traversalsOK:    traversalsOK,
+	}, nil
+}
+
+func (sink *OTLPSink) ReportCounters(country string, bytesGiven int64) error {
+	sink.bytesGiven.Add(context.Background(), bytesGiven,
+		metric.WithAttributes(attribute.String("country", country)))
+	return nil
+}
+
+func (sink *OTLPSink) ReportTraversal(answererCountry string, offererCountry string, outcome *TraversalOutcome) error {
+	attrs := metric.WithAttributes(
+		attribute.String("answerer_country", answererCountry),
+		attribute.String("offerer_country", offererCountry),
+	)
+	ctx := context.Background()
+	sink.traversalsTotal.Add(ctx, int64(outcome.AnswererOnline), attrs)
+	sink.traversalsOK.Add(ctx, int64(outcome.TraversalSucceeded), attrs)
+	return nil
+}
+
+// Flush forces the OTLP exporter to push any metrics buffered since its
+// last periodic export.
+func (sink *OTLPSink) Flush() error {
+	return sink.provider.ForceFlush(context.Background())
+}
+
+// Shutdown stops the sink's periodic exporter and releases its connection
+// to the collector. Callers should call this on process shutdown.
+func (sink *OTLPSink) Shutdown() error {
+	return sink.provider.Shutdown(context.Background())
+}
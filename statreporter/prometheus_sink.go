@@ -0,0 +1,96 @@
+package statreporter
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// PrometheusSink is a Sink that exposes flashlight's stats as Prometheus
+// gauges/counters for scraping, instead of (or alongside) pushing to
+// statshub. Register it with Reporter.RegisterSink and mount Handler at
+// wherever your Prometheus server is configured to scrape (e.g. /metrics).
+type PrometheusSink struct {
+	bytesGivenTotal       prometheus.Counter
+	traversalSuccessRatio *prometheus.GaugeVec
+	dialErrorRate         *prometheus.GaugeVec
+	serverWeight          *prometheus.GaugeVec
+
+	mu               sync.Mutex
+	traversalTotals  map[string]int
+	traversalSuccess map[string]int
+}
+
+// NewPrometheusSink builds a PrometheusSink and registers its metrics with
+// registry.
+func NewPrometheusSink(registry *prometheus.Registry) *PrometheusSink {
+	sink := &PrometheusSink{
+		bytesGivenTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bytes_given_total",
+			Help: "Total bytes given (sent or received) on behalf of clients.",
+		}),
+		traversalSuccessRatio: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "traversal_success_ratio",
+			Help: "Ratio of successful NAT traversals, by answerer country.",
+		}, []string{"answerer_country"}),
+		dialErrorRate: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "server_dial_error_rate",
+			Help: "Current EWMA of dial errors per upstream server, as tracked by the client's health subsystem.",
+		}, []string{"server"}),
+		serverWeight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "server_weight",
+			Help: "Current effective selection weight per upstream server, as tracked by the client's adaptive weight tuning (or the static config, if adaptive weights are disabled).",
+		}, []string{"server"}),
+		traversalTotals:  make(map[string]int),
+		traversalSuccess: make(map[string]int),
+	}
+	registry.MustRegister(sink.bytesGivenTotal, sink.traversalSuccessRatio, sink.dialErrorRate, sink.serverWeight)
+	return sink
+}
+
+// Handler returns the http.Handler that serves this sink's registry in the
+// Prometheus exposition format.
+func (sink *PrometheusSink) Handler(registry *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// RecordErrorRate sets the current dial error rate for the named server, as
+// reported by PrometheusServerStatsSink from Client.ServerStats.
+func (sink *PrometheusSink) RecordErrorRate(server string, errorRate float64) {
+	sink.dialErrorRate.WithLabelValues(server).Set(errorRate)
+}
+
+// RecordServerWeight sets the current effective selection weight for the
+// named server, as reported by PrometheusServerStatsSink from
+// Client.ServerStats.
+func (sink *PrometheusSink) RecordServerWeight(server string, weight int) {
+	sink.serverWeight.WithLabelValues(server).Set(float64(weight))
+}
+
+func (sink *PrometheusSink) ReportCounters(country string, bytesGiven int64) error {
+	sink.bytesGivenTotal.Add(float64(bytesGiven))
+	return nil
+}
+
+func (sink *PrometheusSink) ReportTraversal(answererCountry string, offererCountry string, outcome *TraversalOutcome) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	sink.traversalTotals[answererCountry] += outcome.AnswererOnline
+	sink.traversalSuccess[answererCountry] += outcome.TraversalSucceeded
+
+	total := sink.traversalTotals[answererCountry]
+	ratio := 0.0
+	if total > 0 {
+		ratio = float64(sink.traversalSuccess[answererCountry]) / float64(total)
+	}
+	sink.traversalSuccessRatio.WithLabelValues(answererCountry).Set(ratio)
+	return nil
+}
+
+// Flush is a no-op; Prometheus is pull-based, so there's nothing to push.
+func (sink *PrometheusSink) Flush() error {
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -34,12 +35,50 @@ type TraversalOutcome struct {
 
 type TraversalStats map[string]*TraversalOutcome
 
+// Sink receives the statistics Reporter collects as they're produced. The
+// original statshub HTTP POST behavior is itself just one Sink
+// implementation (statshubSink, always registered); RegisterSink adds
+// others (see NewPrometheusSink, NewOTLPSink) so the same data can be
+// published to modern monitoring stacks without touching the bespoke
+// statshub JSON schema.
+type Sink interface {
+	// ReportCounters reports the point-in-time counters (e.g. bytesGiven)
+	// accumulated over the reporting interval that just elapsed.
+	ReportCounters(country string, bytesGiven int64) error
+
+	// ReportTraversal reports a coalesced NAT traversal outcome for a
+	// single answerer country.
+	ReportTraversal(answererCountry string, offererCountry string, outcome *TraversalOutcome) error
+
+	// Flush gives the sink a chance to push any data it buffers internally.
+	// Pull-based sinks (e.g. Prometheus) can make this a no-op.
+	Flush() error
+}
+
 type Reporter struct {
 	InstanceId        string // (optional) instanceid under which to report statistics
 	Country           string // (optional) country under which to report statistics
 	bytesGiven        int64  // tracks bytes given
 	traversalStats    TraversalStats
 	TraversalOutcomes chan *nattywad.TraversalInfo
+
+	sinksMu sync.Mutex
+	sinks   []Sink
+}
+
+// RegisterSink adds a Sink that will receive every future counters and
+// traversal report, alongside the always-on statshub sink.
+func (reporter *Reporter) RegisterSink(sink Sink) {
+	reporter.sinksMu.Lock()
+	defer reporter.sinksMu.Unlock()
+	reporter.sinks = append(reporter.sinks, sink)
+}
+
+// allSinks returns every registered sink, plus the built-in statshub sink.
+func (reporter *Reporter) allSinks() []Sink {
+	reporter.sinksMu.Lock()
+	defer reporter.sinksMu.Unlock()
+	return append([]Sink{&statshubSink{instanceId: reporter.InstanceId}}, reporter.sinks...)
 }
 
 // OnBytesGiven registers the fact that bytes were given (sent or received)
@@ -47,18 +86,19 @@ func (reporter *Reporter) OnBytesGiven(clientIp string, bytes int64) {
 	atomic.AddInt64(&reporter.bytesGiven, bytes)
 }
 
-// reportStats periodically reports the stats to statshub via HTTP post
+// Start periodically reports the stats to every registered sink
 func (reporter *Reporter) Start() {
 	for {
 		nextInterval := time.Now().Truncate(REPORT_STATS_INTERVAL).Add(REPORT_STATS_INTERVAL)
 		waitTime := nextInterval.Sub(time.Now())
 		time.Sleep(waitTime)
 		bytesGiven := atomic.SwapInt64(&reporter.bytesGiven, 0)
-		err := reporter.postGiveStats(bytesGiven)
-		if err != nil {
-			log.Errorf("Error on posting stats: %s", err)
-		} else {
-			log.Debugf("Reported %d bytesGiven to statshub", bytesGiven)
+		for _, sink := range reporter.allSinks() {
+			if err := sink.ReportCounters(reporter.Country, bytesGiven); err != nil {
+				log.Errorf("Error reporting counters: %s", err)
+				continue
+			}
+			log.Debugf("Reported %d bytesGiven", bytesGiven)
 		}
 	}
 }
@@ -69,38 +109,6 @@ func (reporter *Reporter) ListenForTraversals() {
 	go reporter.coalesceTraversalStats()
 }
 
-func (reporter *Reporter) postStats(jsonBytes []byte) error {
-	url := fmt.Sprintf(STATSHUB_URL_TEMPLATE, reporter.InstanceId)
-	resp, err := http.Post(url, "application/json", bytes.NewReader(jsonBytes))
-	if err != nil {
-		return fmt.Errorf("Unable to post stats to statshub: %s", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("Unexpected response status posting stats to statshub: %d", resp.StatusCode)
-	}
-	return nil
-}
-
-func (reporter *Reporter) postTraversalStat(answererCountry string, outcome *TraversalOutcome) error {
-
-	var buffer bytes.Buffer
-	enc := json.NewEncoder(&buffer)
-
-	report := map[string]interface{}{
-		"dims": map[string]string{
-			"answererCountry": answererCountry,
-			"offererCountry":  reporter.Country,
-			"operatingSystem": runtime.GOOS,
-		},
-		"increments": outcome,
-	}
-	if err := enc.Encode(report); err != nil {
-		return fmt.Errorf("Unable to decode traversal outcome: %s", err)
-	}
-	return reporter.postStats(buffer.Bytes())
-}
-
 // coalesceTraversalStats consolidates NAT traversal reporting
 // timerCh is initially nil and we block until the
 // first traversal happens; future traversals are coalesced
@@ -146,18 +154,35 @@ func (reporter *Reporter) coalesceTraversalStats() {
 				timerCh = timer.C
 			}
 		case <-timerCh:
+			sinks := reporter.allSinks()
 			for answererCountry, outcome := range reporter.traversalStats {
-				reporter.postTraversalStat(answererCountry, outcome)
+				for _, sink := range sinks {
+					if err := sink.ReportTraversal(answererCountry, reporter.Country, outcome); err != nil {
+						log.Errorf("Error reporting traversal stat: %s", err)
+					}
+				}
 				reporter.traversalStats[answererCountry] = nil
 			}
+			for _, sink := range sinks {
+				if err := sink.Flush(); err != nil {
+					log.Errorf("Error flushing sink: %s", err)
+				}
+			}
 		}
 	}
 }
 
-func (reporter *Reporter) postGiveStats(bytesGiven int64) error {
+// statshubSink is the original Sink implementation, posting JSON increments
+// to statshub via HTTP. It's always consulted alongside whatever sinks are
+// registered with Reporter.RegisterSink.
+type statshubSink struct {
+	instanceId string
+}
+
+func (sink *statshubSink) ReportCounters(country string, bytesGiven int64) error {
 	report := map[string]interface{}{
 		"dims": map[string]string{
-			"country": reporter.Country,
+			"country": country,
 		},
 		"increments": map[string]int64{
 			"bytesGiven":             bytesGiven,
@@ -170,5 +195,40 @@ func (reporter *Reporter) postGiveStats(bytesGiven int64) error {
 		return fmt.Errorf("Unable to marshal json for stats: %s", err)
 	}
 
-	return reporter.postStats(jsonBytes)
+	return sink.post(jsonBytes)
+}
+
+func (sink *statshubSink) ReportTraversal(answererCountry string, offererCountry string, outcome *TraversalOutcome) error {
+	var buffer bytes.Buffer
+	enc := json.NewEncoder(&buffer)
+
+	report := map[string]interface{}{
+		"dims": map[string]string{
+			"answererCountry": answererCountry,
+			"offererCountry":  offererCountry,
+			"operatingSystem": runtime.GOOS,
+		},
+		"increments": outcome,
+	}
+	if err := enc.Encode(report); err != nil {
+		return fmt.Errorf("Unable to decode traversal outcome: %s", err)
+	}
+	return sink.post(buffer.Bytes())
+}
+
+func (sink *statshubSink) Flush() error {
+	return nil
+}
+
+func (sink *statshubSink) post(jsonBytes []byte) error {
+	url := fmt.Sprintf(STATSHUB_URL_TEMPLATE, sink.instanceId)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(jsonBytes))
+	if err != nil {
+		return fmt.Errorf("Unable to post stats to statshub: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Unexpected response status posting stats to statshub: %d", resp.StatusCode)
+	}
+	return nil
 }